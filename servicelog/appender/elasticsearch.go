@@ -0,0 +1,375 @@
+package appender
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/allegro/mesos-executor/servicelog"
+	"github.com/allegro/mesos-executor/xio"
+)
+
+const (
+	elasticsearchConfigPrefix = "allegro_executor_servicelog_elasticsearch"
+	elasticsearchBulkPath     = "/_bulk"
+)
+
+type elasticsearchConfig struct {
+	URLs         []string `required:"true"`
+	IndexPattern string   `required:"true" default:"service-logs-2006.01.02"`
+	Pipeline     string
+	Username     string
+	Password     string
+	BatchSize    int           `default:"100"`
+	BatchBytes   int           `default:"1048576"`
+	BatchWait    time.Duration `default:"1s"`
+	Timeout      time.Duration `default:"10s"`
+}
+
+type elasticsearch struct {
+	urls         []string
+	nextURL      uint32
+	indexPattern string
+	pipeline     string
+	username     string
+	password     string
+	formatter    LogstashFormatter
+
+	batchSize  int
+	batchBytes int
+	batchWait  time.Duration
+
+	httpClient *http.Client
+
+	// gate runs rate/size limiting over the formatted document before it is
+	// accepted into the batch, reusing the same xio decorators the Logstash
+	// appender uses.
+	gate io.Writer
+
+	mu         sync.Mutex
+	pending    [][]byte
+	pendingLen int
+	flush      chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	droppedBecauseOfSize metrics.Counter
+	droppedBecauseOfRate metrics.Counter
+	bulkItemFailed       metrics.Counter
+	bulkRequestFailed    metrics.Counter
+}
+
+// Append implements Appender.
+func (e *elasticsearch) Append(entries <-chan servicelog.Entry) {
+	for entry := range entries {
+		if err := e.appendEntry(entry); err != nil {
+			log.WithError(err).Warn("Error appending logs to Elasticsearch.")
+		}
+	}
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *elasticsearch) appendEntry(entry servicelog.Entry) error {
+	document, err := e.formatter.Format(entry)
+	if err != nil {
+		return fmt.Errorf("unable to format log entry: %s", err)
+	}
+	documentBytes, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("unable to marshal log entry: %s", err)
+	}
+
+	if _, err := e.gate.Write(documentBytes); err != nil {
+		if err == xio.ErrSizeLimitExceeded {
+			e.droppedBecauseOfSize.Inc(1)
+			return nil
+		}
+		if err == xio.ErrRateLimitExceeded {
+			e.droppedBecauseOfRate.Inc(1)
+			return nil
+		}
+		return fmt.Errorf("unable to accept log entry: %s", err)
+	}
+
+	action, err := json.Marshal(e.bulkAction())
+	if err != nil {
+		return fmt.Errorf("unable to marshal bulk action: %s", err)
+	}
+
+	e.mu.Lock()
+	e.pending = append(e.pending, action, documentBytes)
+	e.pendingLen += len(action) + len(documentBytes)
+	shouldFlush := len(e.pending)/2 >= e.batchSize || e.pendingLen >= e.batchBytes
+	e.mu.Unlock()
+
+	if shouldFlush {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+type bulkIndexAction struct {
+	Index string `json:"_index"`
+	Type  string `json:"_type,omitempty"`
+}
+
+func (e *elasticsearch) bulkAction() map[string]bulkIndexAction {
+	index := time.Now().UTC().Format(e.indexPattern)
+	return map[string]bulkIndexAction{"index": {Index: index}}
+}
+
+func (e *elasticsearch) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.batchWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flushBatch()
+		case <-e.flush:
+			e.flushBatch()
+		case <-e.done:
+			e.flushBatch()
+			return
+		}
+	}
+}
+
+func (e *elasticsearch) flushBatch() {
+	e.mu.Lock()
+	if len(e.pending) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	batch := e.pending
+	e.pending = nil
+	e.pendingLen = 0
+	e.mu.Unlock()
+
+	var body bytes.Buffer
+	for _, line := range batch {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	if err := e.bulk(body.Bytes()); err != nil {
+		log.WithError(err).Warn("Unable to send bulk request to Elasticsearch.")
+		e.bulkRequestFailed.Inc(1)
+	}
+}
+
+func (e *elasticsearch) bulk(body []byte) error {
+	url := e.nextBulkURL()
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if e.username != "" || e.password != "" {
+		request.SetBasicAuth(e.username, e.password)
+	}
+
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to send bulk request: %s", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read bulk response: %s", err)
+	}
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Elasticsearch responded with status %d: %s", response.StatusCode, responseBody)
+	}
+
+	return e.countBulkItemFailures(responseBody)
+}
+
+type bulkResponse struct {
+	Items []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (e *elasticsearch) countBulkItemFailures(body []byte) error {
+	var response bulkResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unable to parse bulk response: %s", err)
+	}
+
+	for _, item := range response.Items {
+		for _, result := range item {
+			if result.Status/100 != 2 {
+				e.bulkItemFailed.Inc(1)
+				log.WithField("type", result.Error.Type).
+					WithField("reason", result.Error.Reason).
+					Warn("Elasticsearch rejected a bulk item.")
+			}
+		}
+	}
+	return nil
+}
+
+func (e *elasticsearch) nextBulkURL() string {
+	index := atomic.AddUint32(&e.nextURL, 1)
+	url := strings.TrimRight(e.urls[int(index)%len(e.urls)], "/") + elasticsearchBulkPath
+	if e.pipeline != "" {
+		url += "?pipeline=" + e.pipeline
+	}
+	return url
+}
+
+// NewElasticsearch creates a new appender that ships log entries directly to
+// Elasticsearch's `_bulk` endpoint, for deployments that don't run Logstash.
+func NewElasticsearch(urls []string, options ...func(*elasticsearch) error) (Appender, error) {
+	e := &elasticsearch{
+		urls:         urls,
+		indexPattern: "service-logs-2006.01.02",
+		formatter:    LogstashPlainFormatter{},
+		batchSize:    100,
+		batchBytes:   1 << 20,
+		batchWait:    time.Second,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		gate:         ioutil.Discard,
+		flush:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+
+		droppedBecauseOfRate: metrics.GetOrRegisterCounter("servicelog.elasticsearch.dropped.RateExceeded", metrics.DefaultRegistry),
+		droppedBecauseOfSize: metrics.GetOrRegisterCounter("servicelog.elasticsearch.dropped.SizeExceeded", metrics.DefaultRegistry),
+		bulkItemFailed:       metrics.GetOrRegisterCounter("servicelog.elasticsearch.bulk.item_failed", metrics.DefaultRegistry),
+		bulkRequestFailed:    metrics.GetOrRegisterCounter("servicelog.elasticsearch.bulk.request_failed", metrics.DefaultRegistry),
+	}
+	for _, option := range options {
+		if err := option(e); err != nil {
+			return nil, fmt.Errorf("invalid config option: %s", err)
+		}
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e, nil
+}
+
+// ElasticsearchFromEnv creates a new Elasticsearch appender configured from
+// environment variables.
+func ElasticsearchFromEnv() (Appender, error) {
+	config := &elasticsearchConfig{}
+	if err := envconfig.Process(elasticsearchConfigPrefix, config); err != nil {
+		return nil, fmt.Errorf("unable to get Elasticsearch config from env: %s", err)
+	}
+
+	return NewElasticsearch(config.URLs,
+		elasticsearchIndexPattern(config.IndexPattern),
+		elasticsearchPipeline(config.Pipeline),
+		elasticsearchBasicAuth(config.Username, config.Password),
+		elasticsearchBatchSize(config.BatchSize),
+		elasticsearchBatchBytes(config.BatchBytes),
+		elasticsearchBatchWait(config.BatchWait),
+		elasticsearchTimeout(config.Timeout),
+	)
+}
+
+func elasticsearchIndexPattern(pattern string) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		if pattern != "" {
+			e.indexPattern = pattern
+		}
+		return nil
+	}
+}
+
+func elasticsearchPipeline(pipeline string) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.pipeline = pipeline
+		return nil
+	}
+}
+
+func elasticsearchBasicAuth(username, password string) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.username = username
+		e.password = password
+		return nil
+	}
+}
+
+func elasticsearchBatchSize(size int) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.batchSize = size
+		return nil
+	}
+}
+
+func elasticsearchBatchBytes(size int) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.batchBytes = size
+		return nil
+	}
+}
+
+func elasticsearchBatchWait(wait time.Duration) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.batchWait = wait
+		return nil
+	}
+}
+
+func elasticsearchTimeout(timeout time.Duration) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		if timeout > 0 {
+			e.httpClient.Timeout = timeout
+		}
+		return nil
+	}
+}
+
+// ElasticsearchWithFormatter sets the formatter used to turn service log
+// entries into Elasticsearch documents. Defaults to passing the executor's
+// field names through as-is.
+func ElasticsearchWithFormatter(f LogstashFormatter) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.formatter = f
+		return nil
+	}
+}
+
+// ElasticsearchRateLimit adds rate limiting to logs sending. Logs sent in
+// higher rate (log lines per second) will be discarded.
+func ElasticsearchRateLimit(limit int) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.gate = xio.DecorateWriter(e.gate, xio.RateLimit(limit))
+		return nil
+	}
+}
+
+// ElasticsearchSizeLimit adds size limiting to logs sending. Logs that
+// exceed the passed size (in bytes) will be discarded.
+func ElasticsearchSizeLimit(size int) func(*elasticsearch) error {
+	return func(e *elasticsearch) error {
+		e.gate = xio.DecorateWriter(e.gate, xio.SizeLimit(size))
+		return nil
+	}
+}
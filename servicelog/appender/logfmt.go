@@ -0,0 +1,56 @@
+package appender
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// encodeLogfmt renders the given fields as a single logfmt-formatted line,
+// e.g. `key1=value1 key2="value with spaces"`. Keys are sorted so the output
+// is deterministic, which keeps appender tests and fixtures stable.
+func encodeLogfmt(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fields[key]))
+	}
+	return buf.String()
+}
+
+func logfmtValue(value interface{}) string {
+	str := fmt.Sprintf("%v", value)
+	if str == "" || strings.ContainsAny(str, " \t\"=\n\r") {
+		return strconvQuote(str)
+	}
+	return str
+}
+
+func strconvQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\n':
+			buf.WriteString(`\n`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
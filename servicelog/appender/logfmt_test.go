@@ -0,0 +1,45 @@
+package appender
+
+import "testing"
+
+func TestEncodeLogfmt(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		want   string
+	}{
+		{
+			name:   "plain values pass through unquoted",
+			fields: map[string]interface{}{"level": "info", "count": 3},
+			want:   "count=3 level=info",
+		},
+		{
+			name:   "values with spaces are quoted",
+			fields: map[string]interface{}{"msg": "hello world"},
+			want:   `msg="hello world"`,
+		},
+		{
+			name:   "quotes and backslashes are escaped",
+			fields: map[string]interface{}{"msg": `say "hi" to C:\tmp`},
+			want:   `msg="say \"hi\" to C:\\tmp"`,
+		},
+		{
+			name:   "empty string is quoted",
+			fields: map[string]interface{}{"msg": ""},
+			want:   `msg=""`,
+		},
+		{
+			name:   "keys are sorted for deterministic output",
+			fields: map[string]interface{}{"b": "2", "a": "1"},
+			want:   "a=1 b=2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeLogfmt(tt.fields); got != tt.want {
+				t.Errorf("encodeLogfmt(%v) = %q, want %q", tt.fields, got, tt.want)
+			}
+		})
+	}
+}
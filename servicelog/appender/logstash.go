@@ -1,15 +1,22 @@
 package appender
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/allegro/mesos-executor/xio"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rcrowley/go-metrics"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
 	"github.com/allegro/mesos-executor/servicelog"
 )
@@ -17,31 +24,43 @@ import (
 const (
 	logstashVersion      = 1
 	logstashConfigPrefix = "allegro_executor_servicelog_logstash"
+
+	logstashProtocolTLS = "tcp+tls"
 )
 
 type logstashConfig struct {
 	Protocol string `required:"true"`
 	Address  string `required:"true"`
+
+	TLSCACertFile         string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
 }
 
 type logstashEntry map[string]interface{}
 
-type logstash struct {
-	writer io.Writer
-
-	droppedBecauseOfSize metrics.Counter
-	droppedBecauseOfRate metrics.Counter
+// LogstashFormatter turns a service log entry into the fields that will be
+// sent to Logstash. Implement this to align field names with an existing
+// Logstash pipeline (e.g. renaming fields or adding static tags) without
+// forking the appender.
+type LogstashFormatter interface {
+	Format(entry servicelog.Entry) (map[string]interface{}, error)
 }
 
-func (l *logstash) Append(entries <-chan servicelog.Entry) {
-	for entry := range entries {
-		if err := l.sendEntry(entry); err != nil {
-			log.WithError(err).Warn("Error appending logs.")
-		}
-	}
+// logstashLineMarshaler is an optional interface a LogstashFormatter can
+// implement to take over serializing the formatted fields onto the wire.
+// Formatters that don't implement it get the default JSON-per-line encoding.
+type logstashLineMarshaler interface {
+	MarshalLine(entry map[string]interface{}) ([]byte, error)
 }
 
-func (l *logstash) formatEntry(entry servicelog.Entry) logstashEntry {
+// logstashV1Formatter is the default formatter, reproducing Logstash's v1
+// event format (`@timestamp`/`@version`/`message`).
+type logstashV1Formatter struct{}
+
+func (logstashV1Formatter) Format(entry servicelog.Entry) (map[string]interface{}, error) {
 	formattedEntry := logstashEntry{}
 	formattedEntry["@timestamp"] = entry["time"]
 	formattedEntry["@version"] = logstashVersion
@@ -54,11 +73,62 @@ func (l *logstash) formatEntry(entry servicelog.Entry) logstashEntry {
 		formattedEntry[key] = value
 	}
 
-	return formattedEntry
+	return formattedEntry, nil
+}
+
+// LogstashPlainFormatter passes the executor's field names through as-is,
+// without Logstash's v1 `@timestamp`/`@version`/`message` renaming.
+type LogstashPlainFormatter struct{}
+
+// Format implements LogstashFormatter.
+func (LogstashPlainFormatter) Format(entry servicelog.Entry) (map[string]interface{}, error) {
+	formattedEntry := make(map[string]interface{}, len(entry))
+	for key, value := range entry {
+		formattedEntry[key] = value
+	}
+	return formattedEntry, nil
+}
+
+// LogstashLogfmtFormatter renders entries as logfmt lines instead of JSON,
+// for sinks that aren't Logstash itself.
+type LogstashLogfmtFormatter struct{}
+
+// Format implements LogstashFormatter.
+func (LogstashLogfmtFormatter) Format(entry servicelog.Entry) (map[string]interface{}, error) {
+	formattedEntry := make(map[string]interface{}, len(entry))
+	for key, value := range entry {
+		formattedEntry[key] = value
+	}
+	return formattedEntry, nil
+}
+
+// MarshalLine implements logstashLineMarshaler.
+func (LogstashLogfmtFormatter) MarshalLine(entry map[string]interface{}) ([]byte, error) {
+	line := []byte(encodeLogfmt(entry))
+	return append(line, '\n'), nil
+}
+
+type logstash struct {
+	writer    io.Writer
+	formatter LogstashFormatter
+
+	droppedBecauseOfSize metrics.Counter
+	droppedBecauseOfRate metrics.Counter
+}
+
+func (l *logstash) Append(entries <-chan servicelog.Entry) {
+	for entry := range entries {
+		if err := l.sendEntry(entry); err != nil {
+			log.WithError(err).Warn("Error appending logs.")
+		}
+	}
 }
 
 func (l *logstash) sendEntry(entry servicelog.Entry) error {
-	formattedEntry := l.formatEntry(entry)
+	formattedEntry, err := l.formatter.Format(entry)
+	if err != nil {
+		return fmt.Errorf("unable to format log entry: %s", err)
+	}
 	bytes, err := l.marshal(formattedEntry)
 	if err != nil {
 		return fmt.Errorf("unable to marshal log entry: %s", err)
@@ -78,7 +148,11 @@ func (l *logstash) sendEntry(entry servicelog.Entry) error {
 	return nil
 }
 
-func (l *logstash) marshal(entry logstashEntry) ([]byte, error) {
+func (l *logstash) marshal(entry map[string]interface{}) ([]byte, error) {
+	if marshaler, ok := l.formatter.(logstashLineMarshaler); ok {
+		return marshaler.MarshalLine(entry)
+	}
+
 	bytes, err := json.Marshal(entry)
 	if err != nil {
 		return nil, err
@@ -94,6 +168,7 @@ func (l *logstash) marshal(entry logstashEntry) ([]byte, error) {
 func NewLogstash(writer io.Writer, options ...func(*logstash) error) (Appender, error) {
 	l := &logstash{
 		writer:               writer,
+		formatter:            logstashV1Formatter{},
 		droppedBecauseOfRate: metrics.GetOrRegisterCounter("servicelog.logstash.dropped.RateExceeded", metrics.DefaultRegistry),
 		droppedBecauseOfSize: metrics.GetOrRegisterCounter("servicelog.logstash.dropped.SizeExceeded", metrics.DefaultRegistry),
 	}
@@ -105,15 +180,82 @@ func NewLogstash(writer io.Writer, options ...func(*logstash) error) (Appender,
 	return l, nil
 }
 
+// LogstashWithFormatter sets the formatter used to turn service log entries
+// into Logstash fields. Defaults to the v1 `@timestamp`/`@version`/`message`
+// format.
+func LogstashWithFormatter(f LogstashFormatter) func(*logstash) error {
+	return func(l *logstash) error {
+		l.formatter = f
+		return nil
+	}
+}
+
 // LogstashWriterFromEnv creates the connection from the environment  variables
-// for the Logstash appender.
+// for the Logstash appender. The connection transparently re-dials on write
+// errors, buffering pending entries in memory so short outages don't drop
+// logs.
 func LogstashWriterFromEnv() (io.Writer, error) {
 	config := &logstashConfig{}
 	err := envconfig.Process(logstashConfigPrefix, config)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get address from env: %s", err)
 	}
-	return net.Dial(config.Protocol, config.Address)
+
+	dial, err := logstashDialerFromConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build Logstash dialer: %s", err)
+	}
+
+	return xio.NewReconnectingWriter(dial), nil
+}
+
+// logstashDialerFromConfig builds the DialFunc used to (re)connect to
+// Logstash, adding TLS when the configured protocol is "tcp+tls".
+func logstashDialerFromConfig(config *logstashConfig) (xio.DialFunc, error) {
+	if config.Protocol != logstashProtocolTLS {
+		protocol, address := config.Protocol, config.Address
+		return func() (net.Conn, error) {
+			return net.Dial(protocol, address)
+		}, nil
+	}
+
+	tlsConfig, err := logstashTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	address := config.Address
+	return func() (net.Conn, error) {
+		return tls.Dial("tcp", address, tlsConfig)
+	}, nil
+}
+
+func logstashTLSConfig(config *logstashConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	if config.TLSCACertFile != "" {
+		caCert, err := ioutil.ReadFile(config.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("unable to parse CA certificate from %s", config.TLSCACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 // LogstashRateLimit adds rate limiting to logs sending. Logs send in higher rate
@@ -133,3 +275,144 @@ func LogstashSizeLimit(size int) func(*logstash) error {
 		return nil
 	}
 }
+
+// LogstashPerMessageRateLimit adds rate limiting per log message, so a single
+// recurring message (e.g. a repeating stack trace) is throttled independently
+// and can't starve other, unique messages. limit is the number of identical
+// messages allowed per second.
+func LogstashPerMessageRateLimit(limit int) func(*logstash) error {
+	return func(l *logstash) error {
+		l.writer = xio.DecorateWriter(l.writer, xio.PerKeyRateLimit(logstashMessageKey, rate.Limit(limit), limit))
+		return nil
+	}
+}
+
+// logstashVolatileFields are excluded from the fallback hash in
+// logstashMessageKey, since they differ between otherwise-identical
+// messages (e.g. a repeating stack trace) and would otherwise make every
+// line hash to a distinct key.
+var logstashVolatileFields = map[string]bool{
+	"time":       true,
+	"@timestamp": true,
+	"@version":   true,
+}
+
+// logstashMessageKey extracts the log message from an already formatted
+// Logstash line to use as the rate limiting key. It looks for the message
+// under both "message" (the v1 formatter's field) and "msg" (the field used
+// as-is by LogstashPlainFormatter), in JSON or logfmt encoding. When no
+// message field can be found, it falls back to hashing the remaining,
+// non-volatile fields, so lines differing only by timestamp still share a
+// key.
+func logstashMessageKey(line []byte) string {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(line, &entry); err == nil {
+		if key, ok := logstashMessageField(entry); ok {
+			return key
+		}
+		return logstashStableHash(entry)
+	}
+
+	if fields := parseLogfmtLine(line); len(fields) > 0 {
+		entry := make(map[string]interface{}, len(fields))
+		for key, value := range fields {
+			entry[key] = value
+		}
+		if key, ok := logstashMessageField(entry); ok {
+			return key
+		}
+		return logstashStableHash(entry)
+	}
+
+	hash := fnv.New64a()
+	hash.Write(line)
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+func logstashMessageField(entry map[string]interface{}) (string, bool) {
+	if message, ok := entry["message"]; ok {
+		return fmt.Sprintf("%v", message), true
+	}
+	if msg, ok := entry["msg"]; ok {
+		return fmt.Sprintf("%v", msg), true
+	}
+	return "", false
+}
+
+// logstashStableHash hashes entry with volatile fields removed, so it can be
+// used as a rate limiting key even when no message field is present.
+func logstashStableHash(entry map[string]interface{}) string {
+	stable := make(map[string]interface{}, len(entry))
+	for key, value := range entry {
+		if logstashVolatileFields[key] {
+			continue
+		}
+		stable[key] = value
+	}
+
+	bytes, err := json.Marshal(stable)
+	if err != nil {
+		bytes = []byte(fmt.Sprintf("%v", stable))
+	}
+
+	hash := fnv.New64a()
+	hash.Write(bytes)
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// parseLogfmtLine parses a line produced by encodeLogfmt back into fields,
+// honoring the same quoting rules. Malformed tokens are skipped.
+func parseLogfmtLine(line []byte) map[string]string {
+	fields := map[string]string{}
+	s := string(line)
+	i := 0
+	for i < len(s) {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		keyStart := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' {
+			i++
+		}
+		key := s[keyStart:i]
+		if i >= len(s) || s[i] != '=' {
+			continue
+		}
+		i++ // skip '='
+
+		var value string
+		if i < len(s) && s[i] == '"' {
+			i++
+			var buf strings.Builder
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					if s[i] == 'n' {
+						buf.WriteByte('\n')
+						i++
+						continue
+					}
+				}
+				buf.WriteByte(s[i])
+				i++
+			}
+			i++ // skip closing quote
+			value = buf.String()
+		} else {
+			valueStart := i
+			for i < len(s) && s[i] != ' ' {
+				i++
+			}
+			value = s[valueStart:i]
+		}
+
+		if key != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,554 @@
+package appender
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/allegro/mesos-executor/servicelog"
+	"github.com/allegro/mesos-executor/xio"
+)
+
+const (
+	lokiConfigPrefix = "allegro_executor_servicelog_loki"
+	lokiPushPath     = "/loki/api/v1/push"
+
+	lokiMaxRetries   = 3
+	lokiRetryBackoff = 500 * time.Millisecond
+)
+
+// LokiLineEncoding selects how fields that are not promoted to labels get
+// serialized into the Loki log line.
+type LokiLineEncoding int
+
+const (
+	// LokiJSONLine serializes the remaining fields as a JSON object.
+	LokiJSONLine LokiLineEncoding = iota
+	// LokiLogfmtLine serializes the remaining fields as a logfmt line.
+	LokiLogfmtLine
+)
+
+type lokiConfig struct {
+	URL      string `required:"true"`
+	TenantID string
+	Username string
+	Password string
+
+	// LabelKeys lists entry fields to promote to Loki stream labels.
+	LabelKeys []string
+	// StaticLabels is a "key=value,key2=value2" list of labels attached to
+	// every stream in addition to LabelKeys.
+	StaticLabels string
+
+	BatchSize     int           `default:"100"`
+	BatchBytes    int           `default:"1048576"`
+	BatchWait     time.Duration `default:"1s"`
+	MaxLineSize   int           `default:"65536"`
+	GzipThreshold int           `default:"8192"`
+	Timeout       time.Duration `default:"10s"`
+}
+
+// parseLokiStaticLabels parses a "key=value,key2=value2" list into a label
+// map. Malformed pairs are skipped.
+func parseLokiStaticLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			continue
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels
+}
+
+// lokiRecord is a single, already formatted log line waiting to be shipped
+// to Loki alongside the labels of the stream it belongs to.
+type lokiRecord struct {
+	labels map[string]string
+	line   string
+	tsNano int64
+}
+
+type loki struct {
+	url          string
+	tenantID     string
+	username     string
+	password     string
+	labelKeys    []string
+	staticLabels map[string]string
+	encoding     LokiLineEncoding
+
+	batchSize     int
+	batchBytes    int
+	batchWait     time.Duration
+	maxLineSize   int
+	gzipThreshold int
+
+	httpClient *http.Client
+
+	// gate runs rate/size limiting over the formatted log line before it is
+	// accepted into the batch, reusing the same xio decorators the Logstash
+	// appender uses.
+	gate io.Writer
+
+	mu         sync.Mutex
+	pending    []lokiRecord
+	pendingLen int
+	flush      chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	droppedBecauseOfSize  metrics.Counter
+	droppedBecauseOfRate  metrics.Counter
+	droppedBecauseOfBatch metrics.Counter
+}
+
+// loki streams are grouped by their label set, so a stream key is derived by
+// concatenating the label keys in a fixed order (the configured order).
+func (l *loki) streamKey(labels map[string]string) string {
+	var buf bytes.Buffer
+	for _, key := range l.labelKeys {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(labels[key])
+		buf.WriteByte(';')
+	}
+	return buf.String()
+}
+
+func (l *loki) labelsFor(entry servicelog.Entry) map[string]string {
+	labels := make(map[string]string, len(l.labelKeys)+len(l.staticLabels))
+	for key, value := range l.staticLabels {
+		labels[key] = value
+	}
+	for _, key := range l.labelKeys {
+		if value, ok := entry[key]; ok {
+			labels[key] = fmt.Sprintf("%v", value)
+		}
+	}
+	return labels
+}
+
+func (l *loki) lineFor(entry servicelog.Entry) (string, error) {
+	remaining := make(map[string]interface{}, len(entry))
+	for key, value := range entry {
+		if l.isLabelKey(key) {
+			continue
+		}
+		remaining[key] = value
+	}
+
+	switch l.encoding {
+	case LokiLogfmtLine:
+		return encodeLogfmt(remaining), nil
+	default:
+		bytes, err := json.Marshal(remaining)
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	}
+}
+
+func (l *loki) isLabelKey(key string) bool {
+	for _, labelKey := range l.labelKeys {
+		if labelKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Append sends log entries to Loki, batching them in memory and flushing
+// either when a size threshold is reached or on a timer.
+func (l *loki) Append(entries <-chan servicelog.Entry) {
+	for entry := range entries {
+		if err := l.appendEntry(entry); err != nil {
+			log.WithError(err).Warn("Error appending logs to Loki.")
+		}
+	}
+	close(l.done)
+	l.wg.Wait()
+}
+
+func (l *loki) appendEntry(entry servicelog.Entry) error {
+	line, err := l.lineFor(entry)
+	if err != nil {
+		return fmt.Errorf("unable to format log entry: %s", err)
+	}
+	if len(line) > l.maxLineSize {
+		l.droppedBecauseOfSize.Inc(1)
+		return nil
+	}
+
+	if _, err := l.gate.Write([]byte(line)); err != nil {
+		if err == xio.ErrSizeLimitExceeded {
+			l.droppedBecauseOfSize.Inc(1)
+			return nil
+		}
+		if err == xio.ErrRateLimitExceeded {
+			l.droppedBecauseOfRate.Inc(1)
+			return nil
+		}
+		return fmt.Errorf("unable to accept log entry: %s", err)
+	}
+
+	record := lokiRecord{
+		labels: l.labelsFor(entry),
+		line:   line,
+		tsNano: time.Now().UnixNano(),
+	}
+
+	l.mu.Lock()
+	l.pending = append(l.pending, record)
+	l.pendingLen += len(record.line)
+	shouldFlush := len(l.pending) >= l.batchSize || l.pendingLen >= l.batchBytes
+	l.mu.Unlock()
+
+	if shouldFlush {
+		select {
+		case l.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (l *loki) run() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.batchWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flushBatch()
+		case <-l.flush:
+			l.flushBatch()
+		case <-l.done:
+			l.flushBatch()
+			return
+		}
+	}
+}
+
+func (l *loki) flushBatch() {
+	l.mu.Lock()
+	if len(l.pending) == 0 {
+		l.mu.Unlock()
+		return
+	}
+	batch := l.pending
+	l.pending = nil
+	l.pendingLen = 0
+	l.mu.Unlock()
+
+	body, err := l.encodeBatch(batch)
+	if err != nil {
+		log.WithError(err).Warn("Unable to encode Loki batch.")
+		l.droppedBecauseOfBatch.Inc(int64(len(batch)))
+		return
+	}
+
+	if err := l.push(body); err != nil {
+		log.WithError(err).Warn("Unable to push batch to Loki.")
+		l.droppedBecauseOfBatch.Inc(int64(len(batch)))
+	}
+}
+
+// lokiStream is a single entry of the Loki push request's `streams` array.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+func (l *loki) encodeBatch(records []lokiRecord) ([]byte, error) {
+	streams := map[string]*lokiStream{}
+	order := make([]string, 0)
+
+	for _, record := range records {
+		key := l.streamKey(record.labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: record.labels}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(record.tsNano, 10), record.line})
+	}
+
+	payload := lokiPushRequest{}
+	for _, key := range order {
+		payload.Streams = append(payload.Streams, *streams[key])
+	}
+
+	return json.Marshal(payload)
+}
+
+func (l *loki) push(body []byte) error {
+	var backoff = lokiRetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= lokiMaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		lastErr = l.pushOnce(body)
+		if lastErr == nil {
+			return nil
+		}
+		if !isLokiRetryable(lastErr) {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+type lokiStatusError struct {
+	statusCode int
+}
+
+func (e *lokiStatusError) Error() string {
+	return fmt.Sprintf("Loki responded with status %d", e.statusCode)
+}
+
+func isLokiRetryable(err error) bool {
+	statusErr, ok := err.(*lokiStatusError)
+	if !ok {
+		return false
+	}
+	return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= http.StatusInternalServerError
+}
+
+func (l *loki) pushOnce(body []byte) error {
+	encoding := ""
+	payload := body
+	if len(body) > l.gzipThreshold {
+		gzipped, err := gzipBytes(body)
+		if err != nil {
+			return fmt.Errorf("unable to gzip batch: %s", err)
+		}
+		payload = gzipped
+		encoding = "gzip"
+	}
+
+	request, err := http.NewRequest(http.MethodPost, l.url+lokiPushPath, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	if l.tenantID != "" {
+		request.Header.Set("X-Scope-OrgID", l.tenantID)
+	}
+	if l.username != "" || l.password != "" {
+		request.SetBasicAuth(l.username, l.password)
+	}
+
+	response, err := l.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to send batch to Loki: %s", err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode/100 != 2 {
+		return &lokiStatusError{statusCode: response.StatusCode}
+	}
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewLoki creates a new appender that ships log entries to a Grafana Loki
+// instance via the HTTP push API.
+func NewLoki(url string, options ...func(*loki) error) (Appender, error) {
+	l := &loki{
+		url:           url,
+		batchSize:     100,
+		batchBytes:    1 << 20,
+		batchWait:     time.Second,
+		maxLineSize:   64 * 1024,
+		gzipThreshold: 8 * 1024,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		gate:          ioutil.Discard,
+		flush:         make(chan struct{}, 1),
+		done:          make(chan struct{}),
+
+		droppedBecauseOfRate:  metrics.GetOrRegisterCounter("servicelog.loki.dropped.RateExceeded", metrics.DefaultRegistry),
+		droppedBecauseOfSize:  metrics.GetOrRegisterCounter("servicelog.loki.dropped.SizeExceeded", metrics.DefaultRegistry),
+		droppedBecauseOfBatch: metrics.GetOrRegisterCounter("servicelog.loki.dropped.BatchFailed", metrics.DefaultRegistry),
+	}
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return nil, fmt.Errorf("invalid config option: %s", err)
+		}
+	}
+
+	if len(l.labelKeys) == 0 && len(l.staticLabels) == 0 {
+		return nil, fmt.Errorf("at least one of LokiLabelKeys or LokiStaticLabels must be set: Loki rejects streams with no labels")
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	return l, nil
+}
+
+// LokiFromEnv creates a new Loki appender configured from environment
+// variables.
+func LokiFromEnv() (Appender, error) {
+	config := &lokiConfig{}
+	if err := envconfig.Process(lokiConfigPrefix, config); err != nil {
+		return nil, fmt.Errorf("unable to get Loki config from env: %s", err)
+	}
+
+	return NewLoki(config.URL,
+		lokiTenantID(config.TenantID),
+		lokiBasicAuth(config.Username, config.Password),
+		LokiLabelKeys(config.LabelKeys...),
+		LokiStaticLabels(parseLokiStaticLabels(config.StaticLabels)),
+		lokiBatchSize(config.BatchSize),
+		lokiBatchBytes(config.BatchBytes),
+		lokiBatchWait(config.BatchWait),
+		lokiMaxLineSize(config.MaxLineSize),
+		lokiGzipThreshold(config.GzipThreshold),
+		lokiTimeout(config.Timeout),
+	)
+}
+
+func lokiTenantID(tenantID string) func(*loki) error {
+	return func(l *loki) error {
+		l.tenantID = tenantID
+		return nil
+	}
+}
+
+func lokiBasicAuth(username, password string) func(*loki) error {
+	return func(l *loki) error {
+		l.username = username
+		l.password = password
+		return nil
+	}
+}
+
+func lokiBatchSize(size int) func(*loki) error {
+	return func(l *loki) error {
+		l.batchSize = size
+		return nil
+	}
+}
+
+func lokiBatchBytes(size int) func(*loki) error {
+	return func(l *loki) error {
+		l.batchBytes = size
+		return nil
+	}
+}
+
+func lokiBatchWait(wait time.Duration) func(*loki) error {
+	return func(l *loki) error {
+		l.batchWait = wait
+		return nil
+	}
+}
+
+func lokiMaxLineSize(size int) func(*loki) error {
+	return func(l *loki) error {
+		l.maxLineSize = size
+		return nil
+	}
+}
+
+func lokiGzipThreshold(size int) func(*loki) error {
+	return func(l *loki) error {
+		l.gzipThreshold = size
+		return nil
+	}
+}
+
+func lokiTimeout(timeout time.Duration) func(*loki) error {
+	return func(l *loki) error {
+		if timeout > 0 {
+			l.httpClient.Timeout = timeout
+		}
+		return nil
+	}
+}
+
+// LokiLabelKeys sets which entry fields are promoted to Loki stream labels.
+// The remaining fields are serialized into the log line.
+func LokiLabelKeys(keys ...string) func(*loki) error {
+	return func(l *loki) error {
+		l.labelKeys = keys
+		return nil
+	}
+}
+
+// LokiStaticLabels adds labels that are attached to every stream in addition
+// to the ones derived from LokiLabelKeys.
+func LokiStaticLabels(labels map[string]string) func(*loki) error {
+	return func(l *loki) error {
+		l.staticLabels = labels
+		return nil
+	}
+}
+
+// LokiEncoding selects how fields that are not promoted to labels are
+// serialized into the log line.
+func LokiEncoding(encoding LokiLineEncoding) func(*loki) error {
+	return func(l *loki) error {
+		l.encoding = encoding
+		return nil
+	}
+}
+
+// LokiRateLimit adds rate limiting to logs sending. Logs sent in higher rate
+// (log lines per second) will be discarded.
+func LokiRateLimit(limit int) func(*loki) error {
+	return func(l *loki) error {
+		l.gate = xio.DecorateWriter(l.gate, xio.RateLimit(limit))
+		return nil
+	}
+}
+
+// LokiSizeLimit adds size limiting to logs sending. Logs that exceed the
+// passed size (in bytes) will be discarded.
+func LokiSizeLimit(size int) func(*loki) error {
+	return func(l *loki) error {
+		l.gate = xio.DecorateWriter(l.gate, xio.SizeLimit(size))
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package appender
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/allegro/mesos-executor/servicelog"
+)
+
+const defaultMultiAppenderBufferSize = 100
+
+// DropPolicy selects what happens to a log entry when a MultiAppender child's
+// buffer is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards the entry that didn't fit in the buffer.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered entry to make room for the new one.
+	DropOldest
+	// Block waits until the child has room, applying backpressure to the
+	// shared entries channel.
+	Block
+)
+
+// MultiAppenderChild configures a single child of a MultiAppender.
+type MultiAppenderChild struct {
+	// Name identifies the child in metrics and logs. Defaults to the child's
+	// position in the MultiAppender if empty.
+	Name string
+	// Appender is the child appender entries are fanned out to.
+	Appender Appender
+	// BufferSize is the depth of the per-child buffered channel. Defaults to
+	// 100 if zero.
+	BufferSize int
+	// Policy selects what happens when the child's buffer is full. Defaults
+	// to DropNewest.
+	Policy DropPolicy
+}
+
+type multiAppenderChild struct {
+	name     string
+	appender Appender
+	buffer   chan servicelog.Entry
+	policy   DropPolicy
+	dropped  metrics.Counter
+}
+
+type multiAppender struct {
+	children []*multiAppenderChild
+}
+
+// Append implements Appender. It fans each entry out to every child's own
+// buffered channel, so a slow child can't stall the others; each child is
+// drained by its own goroutine calling its Append.
+func (m *multiAppender) Append(entries <-chan servicelog.Entry) {
+	var wg sync.WaitGroup
+	for _, child := range m.children {
+		wg.Add(1)
+		go func(c *multiAppenderChild) {
+			defer wg.Done()
+			c.appender.Append(c.buffer)
+		}(child)
+	}
+
+	for entry := range entries {
+		for _, child := range m.children {
+			child.dispatch(entry)
+		}
+	}
+
+	for _, child := range m.children {
+		close(child.buffer)
+	}
+	wg.Wait()
+}
+
+func (c *multiAppenderChild) dispatch(entry servicelog.Entry) {
+	switch c.policy {
+	case Block:
+		c.buffer <- entry
+	case DropOldest:
+		for {
+			select {
+			case c.buffer <- entry:
+				return
+			default:
+				select {
+				case <-c.buffer:
+					c.dropped.Inc(1)
+				default:
+				}
+			}
+		}
+	default: // DropNewest
+		select {
+		case c.buffer <- entry:
+		default:
+			c.dropped.Inc(1)
+		}
+	}
+}
+
+// NewMultiAppender creates an Appender that fans a single entries channel out
+// to several child appenders, each with its own buffer and backpressure
+// policy, so a slow sink can't stall the others.
+func NewMultiAppender(children ...MultiAppenderChild) (Appender, error) {
+	if len(children) == 0 {
+		return nil, fmt.Errorf("at least one child appender is required")
+	}
+
+	m := &multiAppender{}
+	for i, child := range children {
+		if child.Appender == nil {
+			return nil, fmt.Errorf("child %d has no appender", i)
+		}
+
+		name := child.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i)
+		}
+		bufferSize := child.BufferSize
+		if bufferSize <= 0 {
+			bufferSize = defaultMultiAppenderBufferSize
+		}
+
+		m.children = append(m.children, &multiAppenderChild{
+			name:     name,
+			appender: child.Appender,
+			buffer:   make(chan servicelog.Entry, bufferSize),
+			policy:   child.Policy,
+			dropped:  metrics.GetOrRegisterCounter(fmt.Sprintf("servicelog.multi.dropped.%s", name), metrics.DefaultRegistry),
+		})
+	}
+
+	return m, nil
+}
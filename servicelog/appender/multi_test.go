@@ -0,0 +1,92 @@
+package appender
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/allegro/mesos-executor/servicelog"
+)
+
+func newTestChild(policy DropPolicy, bufferSize int) *multiAppenderChild {
+	return &multiAppenderChild{
+		name:    "test",
+		buffer:  make(chan servicelog.Entry, bufferSize),
+		policy:  policy,
+		dropped: metrics.NewCounter(),
+	}
+}
+
+func drainBuffer(c *multiAppenderChild) []servicelog.Entry {
+	var entries []servicelog.Entry
+	for {
+		select {
+		case e := <-c.buffer:
+			entries = append(entries, e)
+		default:
+			return entries
+		}
+	}
+}
+
+func TestMultiAppenderChild_DropNewestDiscardsTheNewEntry(t *testing.T) {
+	c := newTestChild(DropNewest, 2)
+	c.dispatch(servicelog.Entry{"msg": "1"})
+	c.dispatch(servicelog.Entry{"msg": "2"})
+	c.dispatch(servicelog.Entry{"msg": "3"}) // buffer full, should be dropped
+
+	if got := c.dropped.Count(); got != 1 {
+		t.Fatalf("dropped count = %d, want 1", got)
+	}
+
+	entries := drainBuffer(c)
+	if len(entries) != 2 || entries[0]["msg"] != "1" || entries[1]["msg"] != "2" {
+		t.Fatalf("buffer contents = %v, want [1 2]", entries)
+	}
+}
+
+func TestMultiAppenderChild_DropOldestKeepsTheNewEntry(t *testing.T) {
+	c := newTestChild(DropOldest, 2)
+	c.dispatch(servicelog.Entry{"msg": "1"})
+	c.dispatch(servicelog.Entry{"msg": "2"})
+	c.dispatch(servicelog.Entry{"msg": "3"}) // should evict "1" to make room
+
+	if got := c.dropped.Count(); got != 1 {
+		t.Fatalf("dropped count = %d, want 1", got)
+	}
+
+	entries := drainBuffer(c)
+	if len(entries) != 2 || entries[0]["msg"] != "2" || entries[1]["msg"] != "3" {
+		t.Fatalf("buffer contents = %v, want [2 3]", entries)
+	}
+}
+
+func TestMultiAppenderChild_BlockWaitsForRoom(t *testing.T) {
+	c := newTestChild(Block, 1)
+	c.dispatch(servicelog.Entry{"msg": "1"})
+
+	done := make(chan struct{})
+	go func() {
+		c.dispatch(servicelog.Entry{"msg": "2"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("dispatch returned before the buffer had room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-c.buffer // make room
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch did not unblock once the buffer had room")
+	}
+
+	if got := c.dropped.Count(); got != 0 {
+		t.Fatalf("dropped count = %d, want 0 for the Block policy", got)
+	}
+}
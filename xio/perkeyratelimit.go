@@ -0,0 +1,154 @@
+package xio
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultPerKeyRateLimitMaxKeys         = 1000
+	defaultPerKeyRateLimitSummaryInterval = 30 * time.Second
+)
+
+// PerKeyRateLimitOption configures a decorator created with PerKeyRateLimit.
+type PerKeyRateLimitOption func(*perKeyRateLimitedWriter)
+
+// PerKeyRateLimitMaxKeys bounds how many distinct keys are tracked at once.
+// When the cap is hit, the least-recently-used key's bucket is evicted.
+func PerKeyRateLimitMaxKeys(maxKeys int) PerKeyRateLimitOption {
+	return func(w *perKeyRateLimitedWriter) {
+		w.maxKeys = maxKeys
+	}
+}
+
+// PerKeyRateLimitSummaryInterval sets how often a "N messages suppressed for
+// key X" line is logged (through logrus, not written to the decorated
+// writer) for keys that had writes throttled. Zero disables the summary.
+func PerKeyRateLimitSummaryInterval(interval time.Duration) PerKeyRateLimitOption {
+	return func(w *perKeyRateLimitedWriter) {
+		w.summaryInterval = interval
+	}
+}
+
+type perKeyRateLimitEntry struct {
+	key        string
+	limiter    *rate.Limiter
+	suppressed int
+}
+
+type perKeyRateLimitedWriter struct {
+	next  io.Writer
+	keyFn func([]byte) string
+	limit rate.Limit
+	burst int
+
+	maxKeys         int
+	summaryInterval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// PerKeyRateLimit maintains a bounded LRU of token buckets keyed by keyFn
+// applied to each write's payload, so a single noisy key (e.g. a repeating
+// log line) can't starve the rest of the stream. Writes for a key that has
+// exceeded its bucket are dropped with ErrRateLimitExceeded; writes for
+// other keys pass through unaffected.
+func PerKeyRateLimit(keyFn func([]byte) string, limit rate.Limit, burst int, options ...PerKeyRateLimitOption) func(io.Writer) io.Writer {
+	return func(next io.Writer) io.Writer {
+		w := &perKeyRateLimitedWriter{
+			next:            next,
+			keyFn:           keyFn,
+			limit:           limit,
+			burst:           burst,
+			maxKeys:         defaultPerKeyRateLimitMaxKeys,
+			summaryInterval: defaultPerKeyRateLimitSummaryInterval,
+			entries:         make(map[string]*list.Element),
+			order:           list.New(),
+		}
+		for _, option := range options {
+			option(w)
+		}
+		if w.summaryInterval > 0 {
+			go w.runSummary()
+		}
+		return w
+	}
+}
+
+func (w *perKeyRateLimitedWriter) Write(p []byte) (int, error) {
+	key := w.keyFn(p)
+
+	w.mu.Lock()
+	entry := w.getOrCreateEntry(key)
+	allowed := entry.limiter.Allow()
+	if !allowed {
+		entry.suppressed++
+	}
+	w.mu.Unlock()
+
+	if !allowed {
+		return 0, ErrRateLimitExceeded
+	}
+	return w.next.Write(p)
+}
+
+// getOrCreateEntry returns the rate limit entry for key, creating it (and
+// evicting the least-recently-used entry if the cache is full) if needed.
+// Callers must hold w.mu.
+func (w *perKeyRateLimitedWriter) getOrCreateEntry(key string) *perKeyRateLimitEntry {
+	if elem, ok := w.entries[key]; ok {
+		w.order.MoveToFront(elem)
+		return elem.Value.(*perKeyRateLimitEntry)
+	}
+
+	entry := &perKeyRateLimitEntry{key: key, limiter: rate.NewLimiter(w.limit, w.burst)}
+	elem := w.order.PushFront(entry)
+	w.entries[key] = elem
+
+	if w.order.Len() > w.maxKeys {
+		oldest := w.order.Back()
+		if oldest != nil {
+			w.order.Remove(oldest)
+			delete(w.entries, oldest.Value.(*perKeyRateLimitEntry).key)
+		}
+	}
+
+	return entry
+}
+
+func (w *perKeyRateLimitedWriter) runSummary() {
+	ticker := time.NewTicker(w.summaryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.logSuppressed()
+	}
+}
+
+func (w *perKeyRateLimitedWriter) logSuppressed() {
+	w.mu.Lock()
+	type suppressed struct {
+		key   string
+		count int
+	}
+	var report []suppressed
+	for elem := w.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*perKeyRateLimitEntry)
+		if entry.suppressed > 0 {
+			report = append(report, suppressed{entry.key, entry.suppressed})
+			entry.suppressed = 0
+		}
+	}
+	w.mu.Unlock()
+
+	for _, s := range report {
+		log.WithField("key", s.key).WithField("suppressed", s.count).
+			Infof("%d messages suppressed for key %s", s.count, s.key)
+	}
+}
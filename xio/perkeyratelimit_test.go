@@ -0,0 +1,77 @@
+package xio
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestPerKeyRateLimit_ThrottlesPerKeyIndependently(t *testing.T) {
+	var out bytes.Buffer
+	keyFn := func(p []byte) string { return string(p[:1]) }
+
+	// burst of 1 and a limit of 0 means a key gets exactly one write through,
+	// ever, with no replenishment: deterministic without relying on timing.
+	writer := PerKeyRateLimit(keyFn, rate.Limit(0), 1)(&out)
+
+	if _, err := writer.Write([]byte("A first")); err != nil {
+		t.Fatalf("first write for key A should pass, got error: %s", err)
+	}
+	if _, err := writer.Write([]byte("A second")); err != ErrRateLimitExceeded {
+		t.Fatalf("second write for key A should be throttled, got: %v", err)
+	}
+	if _, err := writer.Write([]byte("B first")); err != nil {
+		t.Fatalf("first write for key B should pass independently of A, got error: %s", err)
+	}
+
+	want := "A firstB first"
+	if out.String() != want {
+		t.Fatalf("writer received %q, want %q", out.String(), want)
+	}
+}
+
+func TestPerKeyRateLimit_EvictsLeastRecentlyUsedKey(t *testing.T) {
+	var out bytes.Buffer
+	keyFn := func(p []byte) string { return string(p[:1]) }
+
+	writer := PerKeyRateLimit(keyFn, rate.Limit(0), 1, PerKeyRateLimitMaxKeys(1))(&out)
+
+	if _, err := writer.Write([]byte("A1")); err != nil {
+		t.Fatalf("first write for key A should pass, got error: %s", err)
+	}
+	if _, err := writer.Write([]byte("B1")); err != nil {
+		t.Fatalf("first write for key B should pass and evict A, got error: %s", err)
+	}
+	// A's bucket was evicted to make room for B, so a fresh bucket is created
+	// and this write is allowed again despite the zero refill rate.
+	if _, err := writer.Write([]byte("A2")); err != nil {
+		t.Fatalf("write for key A after eviction should pass with a fresh bucket, got error: %s", err)
+	}
+}
+
+func TestPerKeyRateLimit_TracksSuppressedCount(t *testing.T) {
+	var out bytes.Buffer
+	keyFn := func(p []byte) string { return string(p[:1]) }
+
+	decorated := PerKeyRateLimit(keyFn, rate.Limit(0), 1)(&out)
+	writer := decorated.(*perKeyRateLimitedWriter)
+
+	writer.Write([]byte("A1"))
+	writer.Write([]byte("A2")) // suppressed
+	writer.Write([]byte("A3")) // suppressed
+
+	elem, ok := writer.entries["A"]
+	if !ok {
+		t.Fatalf("expected an entry for key A")
+	}
+	entry := elem.Value.(*perKeyRateLimitEntry)
+	if entry.suppressed != 2 {
+		t.Fatalf("suppressed count = %d, want 2", entry.suppressed)
+	}
+
+	writer.logSuppressed()
+	if entry.suppressed != 0 {
+		t.Fatalf("suppressed count after logSuppressed = %d, want 0", entry.suppressed)
+	}
+}
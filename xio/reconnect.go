@@ -0,0 +1,262 @@
+package xio
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// DialFunc opens a new connection. It is called by ReconnectingWriter every
+// time the underlying connection needs to be (re)established.
+type DialFunc func() (net.Conn, error)
+
+const (
+	defaultReconnectInitialBackoff = 500 * time.Millisecond
+	defaultReconnectMaxBackoff     = 30 * time.Second
+	defaultReconnectBufferSize     = 1000
+)
+
+// ReconnectingWriter is an io.Writer backed by a connection obtained through
+// a DialFunc. Writes issued while the connection is down (or that fail) are
+// kept in a bounded in-memory buffer and flushed once the writer manages to
+// reconnect, so short outages don't drop logs. Reconnects happen in the
+// background with exponential backoff.
+type ReconnectingWriter struct {
+	dial DialFunc
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	bufferSize     int
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending [][]byte
+
+	reconnect chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	reconnects   metrics.Counter
+	dialFailures metrics.Counter
+	buffered     metrics.Counter
+}
+
+// NewReconnectingWriter creates a ReconnectingWriter that dials connections
+// using dial, and immediately starts trying to connect in the background.
+func NewReconnectingWriter(dial DialFunc, options ...func(*ReconnectingWriter)) *ReconnectingWriter {
+	w := &ReconnectingWriter{
+		dial:           dial,
+		initialBackoff: defaultReconnectInitialBackoff,
+		maxBackoff:     defaultReconnectMaxBackoff,
+		bufferSize:     defaultReconnectBufferSize,
+		reconnect:      make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+
+		reconnects:   metrics.GetOrRegisterCounter("xio.reconnecting_writer.reconnects", metrics.DefaultRegistry),
+		dialFailures: metrics.GetOrRegisterCounter("xio.reconnecting_writer.dial_failures", metrics.DefaultRegistry),
+		buffered:     metrics.GetOrRegisterCounter("xio.reconnecting_writer.buffered", metrics.DefaultRegistry),
+	}
+	for _, option := range options {
+		option(w)
+	}
+
+	go w.run()
+
+	return w
+}
+
+// ReconnectBackoff sets the initial and maximum backoff between reconnect
+// attempts. The backoff doubles after each failed dial.
+func ReconnectBackoff(initial, max time.Duration) func(*ReconnectingWriter) {
+	return func(w *ReconnectingWriter) {
+		w.initialBackoff = initial
+		w.maxBackoff = max
+	}
+}
+
+// ReconnectBufferSize sets how many writes are buffered in memory while the
+// connection is down. Oldest writes are dropped once the buffer is full.
+func ReconnectBufferSize(size int) func(*ReconnectingWriter) {
+	return func(w *ReconnectingWriter) {
+		w.bufferSize = size
+	}
+}
+
+// Write sends p over the current connection, buffering it instead if the
+// writer is disconnected or the write fails. It never waits for a reconnect
+// and never returns an error: outages are handled by buffering and
+// reconnecting in the background. While connected, p is written to the live
+// connection synchronously.
+func (w *ReconnectingWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+
+	w.mu.Lock()
+	conn := w.conn
+	w.mu.Unlock()
+
+	if conn != nil {
+		if _, err := conn.Write(buf); err == nil {
+			return len(p), nil
+		}
+		w.dropConnection(conn)
+	}
+
+	w.enqueue(buf)
+	return len(p), nil
+}
+
+func (w *ReconnectingWriter) enqueue(buf []byte) {
+	w.enqueueAll([][]byte{buf})
+}
+
+// enqueueAll buffers bufs, preserving their order, dropping the oldest
+// buffered writes once the buffer is full. Each buffered write is counted
+// exactly once in the buffered gauge, from here until it is either written
+// or evicted.
+func (w *ReconnectingWriter) enqueueAll(bufs [][]byte) {
+	w.mu.Lock()
+	for _, buf := range bufs {
+		if len(w.pending) >= w.bufferSize {
+			w.pending = w.pending[1:]
+		} else {
+			w.buffered.Inc(1)
+		}
+		w.pending = append(w.pending, buf)
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back bufs that were already counted in the buffered gauge
+// (e.g. the unwritten tail of a failed replay), so it must not inc the
+// gauge again on insert; eviction still decs it, since an evicted buffer
+// really does leave the buffer for good.
+func (w *ReconnectingWriter) requeue(bufs [][]byte) {
+	w.mu.Lock()
+	for _, buf := range bufs {
+		if len(w.pending) >= w.bufferSize {
+			w.pending = w.pending[1:]
+			w.buffered.Dec(1)
+		}
+		w.pending = append(w.pending, buf)
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// dropConnection clears the current connection if it is still the one
+// passed in, so a single broken connection triggers only one reconnect.
+func (w *ReconnectingWriter) dropConnection(conn net.Conn) {
+	w.mu.Lock()
+	if w.conn == conn {
+		w.conn = nil
+	}
+	w.mu.Unlock()
+	conn.Close()
+
+	select {
+	case w.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the background reconnect loop and closes the current
+// connection, if any.
+func (w *ReconnectingWriter) Close() error {
+	w.closeOnce.Do(func() { close(w.closed) })
+
+	w.mu.Lock()
+	conn := w.conn
+	w.conn = nil
+	w.mu.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (w *ReconnectingWriter) run() {
+	backoff := w.initialBackoff
+	for {
+		w.mu.Lock()
+		connected := w.conn != nil
+		w.mu.Unlock()
+
+		if connected {
+			select {
+			case <-w.closed:
+				return
+			case <-w.reconnect:
+				continue
+			}
+		}
+
+		conn, err := w.dial()
+		if err != nil {
+			w.dialFailures.Inc(1)
+			select {
+			case <-w.closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+			continue
+		}
+
+		backoff = w.initialBackoff
+		w.reconnects.Inc(1)
+
+		w.drainPending(conn)
+	}
+}
+
+// drainPending replays everything buffered in w.pending onto conn, in order,
+// before publishing conn as the writer's live connection. It keeps draining
+// until the buffer is empty and conn is published in the same locked section
+// as that check, so a concurrent Write can never interleave with the replay
+// and can never observe a connection that still has a backlog behind it.
+//
+// If conn dies partway through a replay, the unwritten remainder of the
+// batch is re-enqueued as a whole, preserving order, and conn is dropped so
+// the caller redials.
+func (w *ReconnectingWriter) drainPending(conn net.Conn) {
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.conn = conn
+			w.mu.Unlock()
+			return
+		}
+		pending := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+
+		for i, buf := range pending {
+			if _, err := conn.Write(buf); err != nil {
+				// The first i buffers were actually written, so they leave
+				// the buffer; the rest are still buffered and go back in
+				// without being recounted.
+				w.buffered.Dec(int64(i))
+				w.requeue(pending[i:])
+				conn.Close()
+				return
+			}
+		}
+		w.buffered.Dec(int64(len(pending)))
+	}
+}
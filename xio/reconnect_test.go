@@ -0,0 +1,121 @@
+package xio
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn whose Write starts failing once it has
+// recorded failAfter successful writes, simulating a connection flapping
+// mid-flush.
+type fakeConn struct {
+	mu        sync.Mutex
+	writes    [][]byte
+	failAfter int
+	closed    bool
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failAfter >= 0 && len(c.writes) >= c.failAfter {
+		return 0, fmt.Errorf("simulated write failure")
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	c.writes = append(c.writes, buf)
+	return len(p), nil
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) recordedLines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := make([]string, len(c.writes))
+	for i, w := range c.writes {
+		lines[i] = string(w)
+	}
+	return lines
+}
+
+func (c *fakeConn) Read([]byte) (int, error)         { return 0, fmt.Errorf("not implemented") }
+func (c *fakeConn) LocalAddr() net.Addr              { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr             { return nil }
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestReconnectingWriter_PreservesOrderAfterPartialFlushFailure(t *testing.T) {
+	firstConn := &fakeConn{failAfter: 2}
+	secondConn := &fakeConn{failAfter: -1}
+
+	var dialCalls int
+	proceed := make(chan struct{})
+	dial := func() (net.Conn, error) {
+		dialCalls++
+		if dialCalls == 1 {
+			<-proceed
+			return firstConn, nil
+		}
+		return secondConn, nil
+	}
+
+	w := NewReconnectingWriter(dial, ReconnectBackoff(time.Millisecond, 5*time.Millisecond))
+	defer w.Close()
+
+	lines := []string{"line0", "line1", "line2", "line3", "line4"}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Write returned an error: %s", err)
+		}
+	}
+
+	// Let the first dial complete now that every line is buffered, so the
+	// replay of all 5 lines races against the simulated flap after 2 writes.
+	close(proceed)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(secondConn.recordedLines()) >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	gotFirst := firstConn.recordedLines()
+	wantFirst := []string{"line0", "line1"}
+	if !equalStrings(gotFirst, wantFirst) {
+		t.Fatalf("firstConn recorded %v, want %v", gotFirst, wantFirst)
+	}
+
+	gotSecond := secondConn.recordedLines()
+	wantSecond := []string{"line2", "line3", "line4"}
+	if !equalStrings(gotSecond, wantSecond) {
+		t.Fatalf("secondConn recorded %v, want %v (the tail of the batch must survive the flap, in order)", gotSecond, wantSecond)
+	}
+
+	if got := w.buffered.Count(); got != 0 {
+		t.Fatalf("buffered gauge = %d, want 0 once every line has been written (a flap must not leak counts)", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}